@@ -0,0 +1,247 @@
+package cube
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// An Event is one sample of every exported expvar, taken at a particular
+// point in time.
+type Event struct {
+	CollectionType string
+	Timestamp      time.Time
+	Vars           map[string]interface{}
+}
+
+// A Backend knows how to deliver Events to some metrics collector. Run
+// uses the backend selected by the cube_metrics_backend flag; callers who
+// want to bypass the flag machinery can construct a Backend themselves and
+// drive it directly.
+//
+// Event.Vars holds the flattened leaves produced by flattenVars: each
+// value is a float64, bool or string, or a []interface{} or nil for a JSON
+// array or null. Nested expvar.Map and expvar.Func values have already
+// been flattened into dotted keys.
+type Backend interface {
+	Export(ctx context.Context, event Event) error
+}
+
+// A BatchBackend additionally knows how to deliver several Events in a
+// single request, which Run uses when cube_batch_size or
+// cube_flush_interval ask it to accumulate more than one Event before
+// sending.
+type BatchBackend interface {
+	Backend
+	ExportBatch(ctx context.Context, events []Event) error
+}
+
+// CubeBackend posts events to a Cube collector's /1.0/event/put endpoint.
+// This is the original, and still default, export mechanism.
+type CubeBackend struct {
+	PutURL string
+}
+
+// NewCubeBackend returns a Backend that posts to the given Cube collector
+// URL, e.g. http://localhost:1080/1.0/event/put.
+func NewCubeBackend(putURL string) *CubeBackend {
+	return &CubeBackend{PutURL: putURL}
+}
+
+func (b *CubeBackend) Export(ctx context.Context, event Event) error {
+	return b.ExportBatch(ctx, []Event{event})
+}
+
+// ExportBatch posts every event as a single Cube /1.0/event/put array, the
+// way Cube's collector expects when it's fed more than one event at a
+// time. The array is gzip-compressed when the cube_gzip flag is set.
+func (b *CubeBackend) ExportBatch(ctx context.Context, events []Event) error {
+	entries := make([]string, len(events))
+	for i, event := range events {
+		data, err := json.Marshal(event.Vars)
+		if err != nil {
+			log.Printf("Error marshalling expvars to JSON: %v", err)
+			return err
+		}
+		entries[i] = fmt.Sprintf(
+			`{"type": %q, "time": %q, "data": %s}`,
+			event.CollectionType,
+			event.Timestamp.Format(time.ANSIC),
+			data)
+	}
+	request := "[" + strings.Join(entries, ",") + "]"
+
+	body, contentEncoding, err := maybeGzip([]byte(request))
+	if err != nil {
+		log.Printf("Error gzipping request to Cube collector: %v", err)
+		return err
+	}
+
+	response, err := postWithRetry(ctx, b.PutURL, "application/json", contentEncoding, body)
+	if err != nil {
+		log.Printf("Error POSTing events to Cube collector: %v", err)
+		log.Printf("The request we tried to post: %v", request)
+		return err
+	}
+	defer response.Body.Close()
+	return nil
+}
+
+// InfluxDBBackend writes events as line protocol to an InfluxDB /write
+// endpoint. Numeric vars become fields; everything else becomes a tag.
+type InfluxDBBackend struct {
+	URL      string
+	Database string
+	Username string
+	Password string
+}
+
+// NewInfluxDBBackend returns a Backend that writes to the given InfluxDB
+// server and database using line protocol.
+func NewInfluxDBBackend(url, database, username, password string) *InfluxDBBackend {
+	return &InfluxDBBackend{URL: url, Database: database, Username: username, Password: password}
+}
+
+func (b *InfluxDBBackend) Export(ctx context.Context, event Event) error {
+	return b.ExportBatch(ctx, []Event{event})
+}
+
+// ExportBatch writes every event as its own line of InfluxDB line
+// protocol in a single /write request. The body is gzip-compressed when
+// the cube_gzip flag is set.
+func (b *InfluxDBBackend) ExportBatch(ctx context.Context, events []Event) error {
+	lines := make([]string, len(events))
+	for i, event := range events {
+		lines[i] = influxLine(event)
+	}
+	body, contentEncoding, err := maybeGzip([]byte(strings.Join(lines, "\n") + "\n"))
+	if err != nil {
+		log.Printf("Error gzipping request to InfluxDB: %v", err)
+		return err
+	}
+
+	query := url.Values{"db": {b.Database}}
+	if b.Username != "" {
+		query.Set("u", b.Username)
+		query.Set("p", b.Password)
+	}
+	writeURL := fmt.Sprintf("%s/write?%s", strings.TrimRight(b.URL, "/"), query.Encode())
+
+	response, err := postWithRetry(ctx, writeURL, "text/plain", contentEncoding, body)
+	if err != nil {
+		log.Printf("Error POSTing events to InfluxDB: %v", err)
+		log.Printf("The lines we tried to post: %v", lines)
+		return err
+	}
+	defer response.Body.Close()
+	return nil
+}
+
+// influxLine renders one Event as a line of InfluxDB line protocol, using
+// the event's collection type as the measurement name.
+func influxLine(event Event) string {
+	var tags, fields []string
+	for key, value := range event.Vars {
+		switch v := value.(type) {
+		case float64:
+			fields = append(fields, fmt.Sprintf("%s=%v", escapeInfluxIdentifier(key), v))
+		case bool:
+			tags = append(tags, fmt.Sprintf("%s=%t", escapeInfluxIdentifier(key), v))
+		default:
+			tags = append(tags, fmt.Sprintf("%s=%s", escapeInfluxIdentifier(key), escapeInfluxIdentifier(fmt.Sprintf("%v", v))))
+		}
+	}
+	if len(fields) == 0 {
+		// Line protocol requires at least one field.
+		fields = append(fields, "present=1")
+	}
+
+	line := escapeInfluxMeasurement(event.CollectionType)
+	if len(tags) > 0 {
+		line += "," + strings.Join(tags, ",")
+	}
+	line += " " + strings.Join(fields, ",")
+	line += fmt.Sprintf(" %d", event.Timestamp.UnixNano())
+	return line
+}
+
+// escapeInfluxIdentifier escapes the commas, spaces and equals signs that
+// InfluxDB line protocol treats as separators within a tag or field key or
+// a tag value.
+func escapeInfluxIdentifier(s string) string {
+	return influxIdentifierEscaper.Replace(s)
+}
+
+var influxIdentifierEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// escapeInfluxMeasurement escapes the commas and spaces that InfluxDB line
+// protocol treats as separators within a measurement name.
+func escapeInfluxMeasurement(s string) string {
+	return influxMeasurementEscaper.Replace(s)
+}
+
+var influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+
+// prometheusInvalidNameChar matches everything a Prometheus metric name
+// can't contain (it must match [a-zA-Z_:][a-zA-Z0-9_:]*).
+var prometheusInvalidNameChar = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// sanitizeMetricName replaces every character a flattened dotted key can
+// contain but a Prometheus metric name cannot, and guards against a name
+// starting with a digit.
+func sanitizeMetricName(name string) string {
+	sanitized := prometheusInvalidNameChar.ReplaceAllString(name, "_")
+	if sanitized != "" && sanitized[0] >= '0' && sanitized[0] <= '9' {
+		sanitized = "_" + sanitized
+	}
+	return sanitized
+}
+
+// PrometheusBackend pushes events to a Prometheus Pushgateway, under the
+// given job name, in the Prometheus text exposition format. Only numeric
+// vars can be represented; non-numeric vars are skipped. Since the
+// Pushgateway stores a single gauge value per metric regardless of when it
+// was pushed, PrometheusBackend doesn't implement BatchBackend: batching
+// several timestamps would just mean pushing every event but the last for
+// nothing.
+type PrometheusBackend struct {
+	PushURL string
+	Job     string
+}
+
+// NewPrometheusBackend returns a Backend that pushes metrics to the given
+// Prometheus Pushgateway base URL under the given job name.
+func NewPrometheusBackend(pushURL, job string) *PrometheusBackend {
+	return &PrometheusBackend{PushURL: pushURL, Job: job}
+}
+
+func (b *PrometheusBackend) Export(ctx context.Context, event Event) error {
+	var lines []string
+	for key, value := range event.Vars {
+		v, ok := value.(float64)
+		if !ok {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s %v", sanitizeMetricName(event.CollectionType+"_"+key), v))
+	}
+
+	pushURL := fmt.Sprintf("%s/metrics/job/%s", strings.TrimRight(b.PushURL, "/"), b.Job)
+	body, contentEncoding, err := maybeGzip([]byte(strings.Join(lines, "\n") + "\n"))
+	if err != nil {
+		log.Printf("Error gzipping request to Prometheus: %v", err)
+		return err
+	}
+	response, err := postWithRetry(ctx, pushURL, "text/plain", contentEncoding, body)
+	if err != nil {
+		log.Printf("Error pushing metrics to Prometheus: %v", err)
+		log.Printf("The metrics we tried to push: %v", lines)
+		return err
+	}
+	defer response.Body.Close()
+	return nil
+}
@@ -0,0 +1,66 @@
+package cube
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"flag"
+	"time"
+)
+
+var flagBatchSize int
+var flagFlushInterval time.Duration
+var flagGzip bool
+
+func init() {
+	flag.IntVar(&flagBatchSize, "cube_batch_size", 1, "Accumulate this many exports before sending them as a single request. The default of 1 sends every export immediately.")
+	flag.DurationVar(&flagFlushInterval, "cube_flush_interval", 0, "Send accumulated exports at least this often, regardless of cube_batch_size. Zero disables time-based flushing.")
+	flag.BoolVar(&flagGzip, "cube_gzip", false, "Gzip-compress the body of each export request.")
+}
+
+// maybeGzip gzip-compresses body when the cube_gzip flag is set, returning
+// the (possibly unchanged) body and the Content-Encoding header value to
+// send with it ("" when not compressed).
+func maybeGzip(body []byte) ([]byte, string, error) {
+	if !flagGzip {
+		return body, "", nil
+	}
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(body); err != nil {
+		return nil, "", err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+	return compressed.Bytes(), "gzip", nil
+}
+
+// exportEvents delivers events to backend in a single request when backend
+// implements BatchBackend, or one at a time otherwise. It returns the
+// events that still need to be retried (nil if every event was delivered)
+// along with the first error encountered, having still attempted every
+// event regardless of earlier failures.
+//
+// A BatchBackend sends the whole batch as one request, so a batch failure
+// means every event in it needs retrying; a plain Backend is called once
+// per event, so only the events that individually failed do.
+func exportEvents(backend Backend, events []Event) ([]Event, error) {
+	if batchBackend, ok := backend.(BatchBackend); ok {
+		if err := batchBackend.ExportBatch(context.Background(), events); err != nil {
+			return events, err
+		}
+		return nil, nil
+	}
+	var failed []Event
+	var firstErr error
+	for _, event := range events {
+		if err := backend.Export(context.Background(), event); err != nil {
+			failed = append(failed, event)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return failed, firstErr
+}
@@ -0,0 +1,120 @@
+package cube
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+var flagConfigFile string
+
+func init() {
+	flag.StringVar(&flagConfigFile, "cube_config", "", "Optional path to a JSON or YAML file of flag overrides, e.g. {\"cube_export_interval\": \"30s\"}. The format is chosen by the file extension (.yaml/.yml for YAML, anything else for JSON).")
+}
+
+var configureOnce sync.Once
+var configureErr error
+
+// Configure parses the command line if it hasn't been already, then
+// applies environment-variable and config-file overrides to every
+// registered flag, not only the ones this package registers. Only the
+// first call does anything; later calls
+// just return that first call's error, so it's safe to call Configure()
+// more than once. Run() and RunWithRegistry() call this automatically,
+// so you only need to call it yourself if you want to observe its error
+// or control exactly when it runs.
+//
+// For a flag named cube_something, the overriding environment variable is
+// CUBE_SOMETHING; any other flag name is upper-cased and given the CUBE_
+// prefix. A flag set explicitly on the command line always wins;
+// otherwise the environment variable wins over the config file named by
+// -cube_config (or CUBE_CONFIG), which wins over the flag's default.
+//
+// The config file, if given, is a JSON or YAML object mapping flag names
+// to their string values, e.g. {"cube_export_interval": "30s"}. A .yaml
+// or .yml extension selects YAML; anything else is parsed as JSON.
+func Configure() error {
+	configureOnce.Do(func() {
+		configureErr = configure()
+	})
+	return configureErr
+}
+
+func configure() error {
+	if !flag.Parsed() {
+		flag.Parse()
+	}
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	if !explicit["cube_config"] {
+		if value, ok := os.LookupEnv("CUBE_CONFIG"); ok {
+			flagConfigFile = value
+		}
+	}
+	if flagConfigFile != "" {
+		if err := applyConfigFile(flagConfigFile, explicit); err != nil {
+			return err
+		}
+	}
+
+	applyEnv(explicit)
+	return nil
+}
+
+// applyEnv overrides every flag not already set explicitly on the command
+// line with its CUBE_-prefixed environment variable, if any.
+func applyEnv(explicit map[string]bool) {
+	flag.VisitAll(func(f *flag.Flag) {
+		if explicit[f.Name] {
+			return
+		}
+		name := "CUBE_" + strings.ToUpper(strings.TrimPrefix(f.Name, "cube_"))
+		if value, ok := os.LookupEnv(name); ok {
+			if err := flag.Set(f.Name, value); err != nil {
+				log.Printf("Error setting flag %s from %s: %v", f.Name, name, err)
+			}
+		}
+	})
+}
+
+// applyConfigFile overrides every flag named in the JSON or YAML object at
+// path, skipping flags already set explicitly on the command line. The
+// format is chosen by path's extension: .yaml or .yml means YAML, anything
+// else means JSON.
+func applyConfigFile(path string, explicit map[string]bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading cube_config file %s: %v", path, err)
+	}
+	overrides := make(map[string]string)
+	switch ext := filepath.Ext(path); ext {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &overrides); err != nil {
+			return fmt.Errorf("parsing cube_config file %s: %v", path, err)
+		}
+	default:
+		if err := json.Unmarshal(data, &overrides); err != nil {
+			return fmt.Errorf("parsing cube_config file %s: %v", path, err)
+		}
+	}
+	for name, value := range overrides {
+		if explicit[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			log.Printf("Error setting flag %s from %s: %v", name, path, err)
+		}
+	}
+	return nil
+}
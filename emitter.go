@@ -17,8 +17,9 @@
 		)
 
 		func main() {
-			flags.Parse()  // You must parse flags before starting the exporter.
 			go cube.Run("myevents")  // Runs forever, so run it in a goroutine.
+			// Run() applies env var and config file overrides on its own; call
+			// cube.Configure() yourself first only if you need to see its error.
 
 			// Now create and use expvars.
 		}
@@ -27,42 +28,113 @@
 package cube
 
 import (
-	"bytes"
+	"context"
 	"expvar"
 	"flag"
 	"fmt"
 	"log"
-	"net/http"
-	"strings"
 	"time"
+
+	"github.com/rcrowley/go-metrics"
 )
 
 var flagCollectorHost string
 var flagCollectorPort int
 var flagExportInterval string
 var flagExportToCube bool
+var flagMetricsBackend string
+var flagInfluxDBURL string
+var flagInfluxDBDatabase string
+var flagInfluxDBUsername string
+var flagInfluxDBPassword string
+var flagPrometheusPushURL string
+var flagPrometheusJob string
 
 func init() {
 	flag.StringVar(&flagCollectorHost, "cube_collector_host", "localhost", "Export variables to this Cube collector.")
 	flag.IntVar(&flagCollectorPort, "cube_collector_port", 1080, "Use this port when connecting to the Cube collector.")
 	flag.StringVar(&flagExportInterval, "cube_export_interval", "10s", "Export variables to Cube once every interval.")
 	flag.BoolVar(&flagExportToCube, "cube_export", true, "Whether or not to export variables to Cube.")
+	flag.StringVar(&flagMetricsBackend, "cube_metrics_backend", "cube", "Backend to export variables to: cube, influxdb or prometheus.")
+	flag.StringVar(&flagInfluxDBURL, "cube_influxdb_url", "http://localhost:8086", "InfluxDB server URL, used when cube_metrics_backend is influxdb.")
+	flag.StringVar(&flagInfluxDBDatabase, "cube_influxdb_database", "cube", "InfluxDB database, used when cube_metrics_backend is influxdb.")
+	flag.StringVar(&flagInfluxDBUsername, "cube_influxdb_username", "", "InfluxDB username, used when cube_metrics_backend is influxdb.")
+	flag.StringVar(&flagInfluxDBPassword, "cube_influxdb_password", "", "InfluxDB password, used when cube_metrics_backend is influxdb.")
+	flag.StringVar(&flagPrometheusPushURL, "cube_prometheus_pushgateway_url", "http://localhost:9091", "Prometheus Pushgateway base URL, used when cube_metrics_backend is prometheus.")
+	flag.StringVar(&flagPrometheusJob, "cube_prometheus_job", "cube", "Prometheus Pushgateway job name, used when cube_metrics_backend is prometheus.")
+}
+
+// backendFromFlags builds the Backend selected by the cube_metrics_backend
+// flag, defaulting to a CubeBackend pointed at cube_collector_host and
+// cube_collector_port.
+func backendFromFlags() Backend {
+	switch flagMetricsBackend {
+	case "influxdb":
+		return NewInfluxDBBackend(flagInfluxDBURL, flagInfluxDBDatabase, flagInfluxDBUsername, flagInfluxDBPassword)
+	case "prometheus":
+		return NewPrometheusBackend(flagPrometheusPushURL, flagPrometheusJob)
+	default:
+		putUrl := fmt.Sprintf("http://%s:%d/1.0/event/put", flagCollectorHost, flagCollectorPort)
+		return NewCubeBackend(putUrl)
+	}
+}
+
+// snapshotVars returns every currently published expvar, keyed by name.
+func snapshotVars() map[string]expvar.Var {
+	vars := make(map[string]expvar.Var)
+	expvar.Do(func(entry expvar.KeyValue) {
+		vars[entry.Key] = entry.Value
+	})
+	return vars
 }
 
-// Periodically export variables from expvar to a Cube collector. This function
-// never exits under normal circumstances, so you probably want to run it in a
-// goroutine.
+// snapshotFlatVars takes a snapshot of expvars and flattens them, as
+// described by flattenVars, ready for a Backend to export.
+func snapshotFlatVars() map[string]interface{} {
+	return flattenVars(snapshotVars())
+}
+
+// Periodically export variables from expvar to a metrics collector. This
+// function never exits under normal circumstances, so you probably want to
+// run it in a goroutine.
 //
-// You can control the collector hostname and port and how often we export to
-// Cube using the cube_collector_host, cube_collector_port and
-// cube_export_interval flags.
+// You can control the destination collector using the cube_metrics_backend
+// flag (cube, influxdb or prometheus) and its per-backend flags, and how
+// often we export using the cube_export_interval flag.
 func Run(collectionType string) {
+	if err := Configure(); err != nil {
+		log.Printf("Error configuring cube: %v", err)
+	}
 	if !flagExportToCube {
 		return
 	}
+	RunWithRegistry(collectionType, metrics.DefaultRegistry)
+}
 
-	putUrl := fmt.Sprintf("http://%s:%d/1.0/event/put", flagCollectorHost, flagCollectorPort)
-	log.Printf("Exporting expvars to %s with event type %s", putUrl, collectionType)
+// Periodically export variables from expvar to the given Backend. This
+// function never exits under normal circumstances, so you probably want to
+// run it in a goroutine.
+//
+// Use this instead of Run() when you want to choose or configure a backend
+// in code rather than through flags.
+//
+// Samples are taken every cube_export_interval, but aren't necessarily
+// sent immediately: cube_batch_size and cube_flush_interval control how
+// many samples accumulate into a single request, which lets callers sample
+// frequently without paying for an HTTP round-trip every time.
+func RunWithBackend(collectionType string, backend Backend) {
+	runLoop(collectionType, backend, snapshotFlatVars)
+}
+
+// runLoop is the shared sampling/batching/flushing loop behind RunWithBackend
+// and RunWithRegistryAndBackend. It calls sample once per cube_export_interval
+// to build the vars for that tick's Event, and defers to exportEvents and the
+// retry buffer to actually deliver them according to cube_batch_size and
+// cube_flush_interval.
+func runLoop(collectionType string, backend Backend, sample func() map[string]interface{}) {
+	if err := Configure(); err != nil {
+		log.Printf("Error configuring cube: %v", err)
+	}
 
 	interval, err := time.ParseDuration(flagExportInterval)
 	if err != nil {
@@ -70,12 +142,47 @@ func Run(collectionType string) {
 	}
 	log.Printf("Exporting variables every %v", interval)
 
+	sampleTicker := time.NewTicker(interval)
+	defer sampleTicker.Stop()
+
+	var flushTicker <-chan time.Time
+	if flagFlushInterval > 0 {
+		ticker := time.NewTicker(flagFlushInterval)
+		defer ticker.Stop()
+		flushTicker = ticker.C
+	}
+
 	exportCounter := expvar.NewInt("CubeExports")
-	for now := range time.Tick(interval) {
-		if err := ExportVariablesWithTimestamp(collectionType, putUrl, now); err != nil {
-			log.Printf("Error exporting variables for %v", now)
+	var pending []Event
+
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		batch := pending
+		pending = nil
+		failed, err := exportEvents(backend, batch)
+		if err != nil {
+			log.Printf("Error exporting %d of %d variable samples: %v", len(failed), len(batch), err)
+			for _, event := range failed {
+				bufferEvent(event)
+			}
+		} else {
+			drainBuffer(backend)
+		}
+	}
+
+	for {
+		select {
+		case now := <-sampleTicker.C:
+			pending = append(pending, Event{collectionType, now, sample()})
+			exportCounter.Add(1)
+			if flagBatchSize <= 1 || len(pending) >= flagBatchSize {
+				flush()
+			}
+		case <-flushTicker:
+			flush()
 		}
-		exportCounter.Add(1)
 	}
 }
 
@@ -94,28 +201,6 @@ func ExportVariables(collectionType string, putUrl string) error {
 // You shouldn't need this function under normal circumstances. Use Run()
 // instead.
 func ExportVariablesWithTimestamp(collectionType string, putUrl string, timestamp time.Time) error {
-	variables := make([]string, 0)
-	expvar.Do(func(entry expvar.KeyValue) {
-		variables = append(variables, fmt.Sprintf("%q: %s", entry.Key, entry.Value))
-	})
-	request := fmt.Sprintf(
-		`[
-		{
-			"type": "%s",
-			"time": "%s",
-			"data": { %s }
-		}
-		]`,
-		collectionType,
-		timestamp.Format(time.ANSIC),
-		strings.Join(variables, ","))
-
-	response, err := http.Post(putUrl, "application/json", bytes.NewBufferString(request))
-	if err != nil {
-		log.Printf("Error POSTing events to Cube collector: %v", err)
-		log.Printf("The request we tried to post: %v", request)
-		return err
-	}
-	defer response.Body.Close()
-	return nil
+	backend := NewCubeBackend(putUrl)
+	return backend.Export(context.Background(), Event{collectionType, timestamp, snapshotFlatVars()})
 }
@@ -0,0 +1,44 @@
+package cube
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+)
+
+// flattenVars takes a snapshot of expvars and flattens each one into leaf
+// values suitable for a backend to export. expvar.Var.String() already
+// returns valid JSON (plain numbers and strings for expvar.Int/Float/String,
+// objects for expvar.Map, and whatever the wrapped value marshals to for
+// expvar.Func), so we decode that JSON and walk it rather than treating it
+// as an opaque string. Nested objects are flattened using dotted key
+// prefixes, e.g. a Func named "connection_status" returning
+// {"uptime": 12.5} becomes the leaf "connection_status.uptime".
+//
+// Leaves are float64, bool or string, except that JSON arrays and null are
+// not flattened further and are kept as a single []interface{} or nil
+// leaf; callers decide how to treat each kind (e.g. numeric leaves as data
+// fields, string leaves as tags).
+func flattenVars(vars map[string]expvar.Var) map[string]interface{} {
+	leaves := make(map[string]interface{})
+	for key, value := range vars {
+		var decoded interface{}
+		if err := json.Unmarshal([]byte(value.String()), &decoded); err != nil {
+			log.Printf("Error decoding expvar %q as JSON: %v", key, err)
+			continue
+		}
+		flattenLeaf(key, decoded, leaves)
+	}
+	return leaves
+}
+
+func flattenLeaf(key string, value interface{}, leaves map[string]interface{}) {
+	nested, ok := value.(map[string]interface{})
+	if !ok {
+		leaves[key] = value
+		return
+	}
+	for childKey, childValue := range nested {
+		flattenLeaf(key+"."+childKey, childValue, leaves)
+	}
+}
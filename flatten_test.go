@@ -0,0 +1,58 @@
+package cube
+
+import (
+	"expvar"
+	"reflect"
+	"testing"
+)
+
+func TestFlattenVars(t *testing.T) {
+	intVar := expvar.NewInt("TestFlattenVarsInt")
+	intVar.Set(42)
+
+	mapVar := expvar.NewMap("TestFlattenVarsMap")
+	mapVar.Set("inner", func() expvar.Var {
+		v := new(expvar.Float)
+		v.Set(1.5)
+		return v
+	}())
+
+	funcVar := expvar.Func(func() interface{} {
+		return map[string]interface{}{"uptime": 12.5, "status": "ok"}
+	})
+	expvar.Publish("TestFlattenVarsFunc", funcVar)
+
+	got := flattenVars(map[string]expvar.Var{
+		"TestFlattenVarsInt":  intVar,
+		"TestFlattenVarsMap":  mapVar,
+		"TestFlattenVarsFunc": funcVar,
+	})
+
+	want := map[string]interface{}{
+		"TestFlattenVarsInt":         42.0,
+		"TestFlattenVarsMap.inner":   1.5,
+		"TestFlattenVarsFunc.uptime": 12.5,
+		"TestFlattenVarsFunc.status": "ok",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("flattenVars() = %#v, want %#v", got, want)
+	}
+}
+
+func TestFlattenLeafNested(t *testing.T) {
+	leaves := make(map[string]interface{})
+	flattenLeaf("a", map[string]interface{}{
+		"b": map[string]interface{}{
+			"c": 1.0,
+		},
+		"d": "x",
+	}, leaves)
+
+	want := map[string]interface{}{
+		"a.b.c": 1.0,
+		"a.d":   "x",
+	}
+	if !reflect.DeepEqual(leaves, want) {
+		t.Errorf("flattenLeaf() = %#v, want %#v", leaves, want)
+	}
+}
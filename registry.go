@@ -0,0 +1,84 @@
+package cube
+
+import (
+	"github.com/rcrowley/go-metrics"
+)
+
+// RunWithRegistry periodically exports both expvars and the metrics in reg
+// to a metrics collector, merging them into a single Event per tick. Use
+// this instead of Run when your service publishes via rcrowley/go-metrics,
+// which offers histograms, meters and timers that expvar lacks. Run itself
+// is a thin wrapper around RunWithRegistry using metrics.DefaultRegistry.
+//
+// This function never exits under normal circumstances, so you probably
+// want to run it in a goroutine.
+func RunWithRegistry(collectionType string, reg metrics.Registry) {
+	RunWithRegistryAndBackend(collectionType, reg, backendFromFlags())
+}
+
+// RunWithRegistryAndBackend is RunWithRegistry, but exporting to the given
+// Backend instead of the one selected by flags.
+func RunWithRegistryAndBackend(collectionType string, reg metrics.Registry, backend Backend) {
+	runLoop(collectionType, backend, func() map[string]interface{} {
+		vars := snapshotFlatVars()
+		for key, value := range flattenRegistry(reg) {
+			vars[key] = value
+		}
+		return vars
+	})
+}
+
+// flattenRegistry walks reg and derives the flat leaves a dashboard wants
+// from each metric kind, keyed by "<name>.<derived series>":
+//
+//	Counter:   count
+//	Meter:     rate1, rate5, mean
+//	Histogram: p50, p95, p99, min, max
+//	Timer:     the union of Meter and Histogram, since a Timer is both
+func flattenRegistry(reg metrics.Registry) map[string]interface{} {
+	leaves := make(map[string]interface{})
+	reg.Each(func(name string, metric interface{}) {
+		switch m := metric.(type) {
+		case metrics.Counter:
+			leaves[name+".count"] = float64(m.Count())
+		case metrics.Meter:
+			addMeterLeaves(leaves, name, m.Snapshot())
+		case metrics.Histogram:
+			addHistogramLeaves(leaves, name, m.Snapshot())
+		case metrics.Timer:
+			addTimerLeaves(leaves, name, m.Snapshot())
+		}
+	})
+	return leaves
+}
+
+func addMeterLeaves(leaves map[string]interface{}, name string, m metrics.Meter) {
+	leaves[name+".rate1"] = m.Rate1()
+	leaves[name+".rate5"] = m.Rate5()
+	leaves[name+".mean"] = m.RateMean()
+}
+
+func addHistogramLeaves(leaves map[string]interface{}, name string, h metrics.Histogram) {
+	percentiles := h.Percentiles([]float64{0.5, 0.95, 0.99})
+	leaves[name+".p50"] = percentiles[0]
+	leaves[name+".p95"] = percentiles[1]
+	leaves[name+".p99"] = percentiles[2]
+	leaves[name+".min"] = float64(h.Min())
+	leaves[name+".max"] = float64(h.Max())
+}
+
+// addTimerLeaves is addMeterLeaves and addHistogramLeaves combined, since a
+// metrics.Timer is both a Meter and a Histogram but its Snapshot() returns
+// a Timer rather than either of those interfaces.
+func addTimerLeaves(leaves map[string]interface{}, name string, t metrics.Timer) {
+	leaves[name+".rate1"] = t.Rate1()
+	leaves[name+".rate5"] = t.Rate5()
+	leaves[name+".mean"] = t.RateMean()
+
+	percentiles := t.Percentiles([]float64{0.5, 0.95, 0.99})
+	leaves[name+".p50"] = percentiles[0]
+	leaves[name+".p95"] = percentiles[1]
+	leaves[name+".p99"] = percentiles[2]
+	leaves[name+".min"] = float64(t.Min())
+	leaves[name+".max"] = float64(t.Max())
+}
@@ -0,0 +1,161 @@
+package cube
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+var flagHTTPTimeout time.Duration
+var flagMaxRetries int
+var flagBufferSize int
+
+var cubeExportErrors = expvar.NewInt("CubeExportErrors")
+var cubeExportRetries = expvar.NewInt("CubeExportRetries")
+var cubeBufferedEvents = expvar.NewInt("CubeBufferedEvents")
+
+func init() {
+	flag.DurationVar(&flagHTTPTimeout, "cube_http_timeout", 10*time.Second, "Timeout for each HTTP request to the metrics collector.")
+	flag.IntVar(&flagMaxRetries, "cube_max_retries", 5, "Number of times to retry a failed export, with exponential backoff, before buffering it.")
+	flag.IntVar(&flagBufferSize, "cube_buffer_size", 1000, "Number of failed exports to buffer in memory for redelivery once the collector is reachable again.")
+}
+
+const retryBaseDelay = 500 * time.Millisecond
+const retryMaxDelay = 30 * time.Second
+
+// postWithRetry POSTs body to url using a client bounded by the
+// cube_http_timeout flag, retrying up to cube_max_retries times with
+// jittered exponential backoff (base 500ms, capped at 30s) before giving
+// up. A non-2xx response is treated the same as a transport error and
+// retried, since a collector that's merely overloaded or rejecting a
+// malformed payload shouldn't silently drop the event. contentEncoding is
+// set as the Content-Encoding header when non-empty (e.g. "gzip" for a
+// gzip-compressed body).
+//
+// ctx bounds the whole call: it's attached to every request via
+// http.NewRequestWithContext, and cancelling it also interrupts an
+// in-progress backoff sleep.
+func postWithRetry(ctx context.Context, url, contentType, contentEncoding string, body []byte) (*http.Response, error) {
+	client := &http.Client{Timeout: flagHTTPTimeout}
+
+	maxRetries := flagMaxRetries
+	if retryDisabled(ctx) {
+		maxRetries = 0
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			delay := backoffDelay(attempt)
+			log.Printf("Retrying POST to %s in %v (attempt %d/%d)", url, delay, attempt+1, maxRetries+1)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			cubeExportRetries.Add(1)
+		}
+		request, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Content-Type", contentType)
+		if contentEncoding != "" {
+			request.Header.Set("Content-Encoding", contentEncoding)
+		}
+		response, err := client.Do(request)
+		if err == nil {
+			if response.StatusCode >= 200 && response.StatusCode < 300 {
+				return response, nil
+			}
+			err = fmt.Errorf("collector returned %s", response.Status)
+			response.Body.Close()
+		}
+		lastErr = err
+	}
+	cubeExportErrors.Add(1)
+	return nil, lastErr
+}
+
+type contextKey int
+
+const noRetryContextKey contextKey = 0
+
+// withNoRetry returns a context that tells postWithRetry to make a single
+// attempt with no backoff, for callers (like drainBuffer) that already
+// queue failures for a later retry and shouldn't stack their own retry
+// loop on top.
+func withNoRetry(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noRetryContextKey, true)
+}
+
+func retryDisabled(ctx context.Context) bool {
+	disabled, _ := ctx.Value(noRetryContextKey).(bool)
+	return disabled
+}
+
+// backoffDelay returns a jittered exponential backoff delay for the given
+// retry attempt (1-indexed), doubling from retryBaseDelay and capped at
+// retryMaxDelay.
+func backoffDelay(attempt int) time.Duration {
+	delay := retryBaseDelay << uint(attempt-1)
+	if delay <= 0 || delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(delay)))
+}
+
+// exportBuffer holds events that failed to export even after exhausting
+// retries, kept around so we can resend them once the collector is
+// reachable again.
+var exportBuffer []Event
+
+// bufferEvent enqueues an event that failed to export after exhausting
+// retries. If the buffer is full, the oldest buffered event is dropped to
+// make room; we'd rather lose old samples than grow without bound.
+func bufferEvent(event Event) {
+	if flagBufferSize <= 0 {
+		return
+	}
+	if len(exportBuffer) >= flagBufferSize {
+		exportBuffer = exportBuffer[1:]
+	}
+	exportBuffer = append(exportBuffer, event)
+	cubeBufferedEvents.Set(int64(len(exportBuffer)))
+}
+
+// drainBatchLimit bounds how many buffered events drainBuffer will retry
+// in a single call, so that redelivering a large backlog built up during
+// an outage can't stall sampling for multiple ticks in a row.
+const drainBatchLimit = 50
+
+// drainBuffer retries up to drainBatchLimit of the oldest buffered events
+// against backend, keeping only the ones that still fail. Each event gets
+// a single attempt rather than the full postWithRetry backoff cycle,
+// since a failure here just leaves the event in the buffer for the next
+// call to drainBuffer.
+func drainBuffer(backend Backend) {
+	if len(exportBuffer) == 0 {
+		return
+	}
+	toDrain := exportBuffer
+	if len(toDrain) > drainBatchLimit {
+		toDrain = toDrain[:drainBatchLimit]
+	}
+
+	ctx := withNoRetry(context.Background())
+	var remaining []Event
+	for _, event := range toDrain {
+		if err := backend.Export(ctx, event); err != nil {
+			remaining = append(remaining, event)
+		}
+	}
+	exportBuffer = append(remaining, exportBuffer[len(toDrain):]...)
+	cubeBufferedEvents.Set(int64(len(exportBuffer)))
+}
@@ -0,0 +1,127 @@
+package cube
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	for attempt := 1; attempt <= 10; attempt++ {
+		delay := backoffDelay(attempt)
+		if delay < 0 || delay > retryMaxDelay {
+			t.Errorf("backoffDelay(%d) = %v, want in [0, %v]", attempt, delay, retryMaxDelay)
+		}
+	}
+}
+
+func TestBackoffDelayCapsAtMax(t *testing.T) {
+	// Once the doubled base delay would overflow or exceed retryMaxDelay,
+	// backoffDelay should jitter within [0, retryMaxDelay] rather than
+	// keep growing or wrapping negative.
+	delay := backoffDelay(63)
+	if delay < 0 || delay > retryMaxDelay {
+		t.Errorf("backoffDelay(63) = %v, want in [0, %v]", delay, retryMaxDelay)
+	}
+}
+
+// stubBackend records every event passed to Export and fails the ones
+// whose CollectionType is in failFor.
+type stubBackend struct {
+	exported []Event
+	failFor  map[string]bool
+}
+
+var errFakeExport = errors.New("fake export failure")
+
+func (b *stubBackend) Export(ctx context.Context, event Event) error {
+	b.exported = append(b.exported, event)
+	if b.failFor[event.CollectionType] {
+		return errFakeExport
+	}
+	return nil
+}
+
+func resetBuffer(t *testing.T, size int) {
+	t.Helper()
+	previousBuffer := exportBuffer
+	previousSize := flagBufferSize
+	exportBuffer = nil
+	flagBufferSize = size
+	t.Cleanup(func() {
+		exportBuffer = previousBuffer
+		flagBufferSize = previousSize
+	})
+}
+
+func TestBufferEventEvictsOldestWhenFull(t *testing.T) {
+	resetBuffer(t, 2)
+
+	bufferEvent(Event{CollectionType: "a"})
+	bufferEvent(Event{CollectionType: "b"})
+	bufferEvent(Event{CollectionType: "c"})
+
+	if len(exportBuffer) != 2 {
+		t.Fatalf("len(exportBuffer) = %d, want 2", len(exportBuffer))
+	}
+	if exportBuffer[0].CollectionType != "b" || exportBuffer[1].CollectionType != "c" {
+		t.Errorf("exportBuffer = %v, want [b c]", exportBuffer)
+	}
+}
+
+func TestDrainBufferKeepsOnlyFailedEvents(t *testing.T) {
+	resetBuffer(t, 10)
+
+	exportBuffer = []Event{
+		{CollectionType: "ok"},
+		{CollectionType: "fail"},
+		{CollectionType: "ok"},
+	}
+	backend := &stubBackend{failFor: map[string]bool{"fail": true}}
+
+	drainBuffer(backend)
+
+	if len(exportBuffer) != 1 || exportBuffer[0].CollectionType != "fail" {
+		t.Errorf("exportBuffer = %v, want only the failed event", exportBuffer)
+	}
+	if len(backend.exported) != 3 {
+		t.Errorf("backend saw %d events, want 3", len(backend.exported))
+	}
+}
+
+func TestDrainBufferRespectsBatchLimit(t *testing.T) {
+	resetBuffer(t, drainBatchLimit*2)
+
+	exportBuffer = make([]Event, drainBatchLimit+5)
+	backend := &stubBackend{}
+
+	drainBuffer(backend)
+
+	if len(backend.exported) != drainBatchLimit {
+		t.Errorf("backend saw %d events, want %d", len(backend.exported), drainBatchLimit)
+	}
+	if len(exportBuffer) != 5 {
+		t.Errorf("exportBuffer left with %d events, want 5", len(exportBuffer))
+	}
+}
+
+func TestWithNoRetryDisablesRetries(t *testing.T) {
+	ctx := context.Background()
+	if retryDisabled(ctx) {
+		t.Error("retryDisabled(context.Background()) = true, want false")
+	}
+	ctx = withNoRetry(ctx)
+	if !retryDisabled(ctx) {
+		t.Error("retryDisabled(withNoRetry(ctx)) = false, want true")
+	}
+}
+
+func TestPostWithRetryHonorsContextCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := postWithRetry(ctx, "http://127.0.0.1:0", "text/plain", "", nil)
+	if err == nil {
+		t.Fatal("postWithRetry with a cancelled context returned no error")
+	}
+}